@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WatchExpirations subscribes to Redis keyspace notifications for expired
+// keys and counts each expired secret via CountSecretExpired. A secret whose
+// last allowed read was used is removed via DEL rather than letting its TTL
+// run out, so only secrets with reads still remaining show up here; a secret
+// allowed several reads is counted even if some of them were used. Keys
+// written by pkg/ratelimit ("ratelimit:" prefix), which may share the same
+// Redis, are skipped. It blocks until ctx is cancelled, so callers should run
+// it in its own goroutine.
+//
+// Redis must have `notify-keyspace-events` configured to include "Ex" (or
+// "KEA") for the __keyevent@<db>__:expired channel to receive events.
+func (c *Collector) WatchExpirations(ctx context.Context, client redis.UniversalClient, db int) {
+	channel := "__keyevent@" + strconv.Itoa(db) + "__:expired"
+	pubsub := client.PSubscribe(ctx, channel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(msg.Payload, "ratelimit:") {
+				continue
+			}
+			c.CountSecretExpired()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package metrics exposes Prometheus instrumentation for KeeDrop's secret
+// storage and retrieval paths.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Error reasons reported alongside the create/read error counters. These are
+// shared constants so handlers and storage backends agree on the label
+// values scraped by Prometheus.
+const (
+	ReasonInvalidJSON             = "invalid_json"
+	ReasonSecretMissing           = "secret_missing"
+	ReasonSecretTooLarge          = "secret_too_large"
+	ReasonStorageError            = "storage_error"
+	ReasonSecretNotFound          = "secret_not_found"
+	ReasonMnemoCollisionExhausted = "mnemo_collision_exhausted"
+)
+
+// Collector bundles all of the counters and histograms KeeDrop reports. It
+// is safe for concurrent use, same as the prometheus client types it wraps.
+type Collector struct {
+	secretsCreated   prometheus.Counter
+	secretsRetrieved prometheus.Counter
+	secretsExpired   prometheus.Counter
+	createErrors     *prometheus.CounterVec
+	readErrors       *prometheus.CounterVec
+	handlerLatency   *prometheus.HistogramVec
+	storageLatency   *prometheus.HistogramVec
+}
+
+// NewCollector creates a Collector and registers its metrics with reg. Pass
+// prometheus.DefaultRegisterer to use the global registry.
+func NewCollector(reg prometheus.Registerer) *Collector {
+	c := &Collector{
+		secretsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keedrop_secrets_created_total",
+			Help: "Number of secrets successfully stored.",
+		}),
+		secretsRetrieved: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keedrop_secrets_retrieved_total",
+			Help: "Number of secrets successfully retrieved.",
+		}),
+		secretsExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keedrop_secrets_expired_total",
+			Help: "Number of secrets that expired with reads still remaining (for single-read secrets: never retrieved).",
+		}),
+		createErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keedrop_secret_create_errors_total",
+			Help: "Number of errors while storing a secret, broken down by reason.",
+		}, []string{"reason"}),
+		readErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keedrop_secret_read_errors_total",
+			Help: "Number of errors while retrieving a secret, broken down by reason.",
+		}, []string{"reason"}),
+		handlerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keedrop_handler_duration_seconds",
+			Help:    "End-to-end latency of the secret create/retrieve handlers.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		storageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "keedrop_storage_round_trip_seconds",
+			Help:    "Round-trip latency of storage backend calls made while storing or retrieving a secret.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+	reg.MustRegister(
+		c.secretsCreated,
+		c.secretsRetrieved,
+		c.secretsExpired,
+		c.createErrors,
+		c.readErrors,
+		c.handlerLatency,
+		c.storageLatency,
+	)
+	return c
+}
+
+// Handler returns the HTTP handler that serves the /metrics endpoint.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// CountSecretCreated records a successfully stored secret.
+func (c *Collector) CountSecretCreated() {
+	c.secretsCreated.Inc()
+}
+
+// CountSecretRetrieved records a successfully retrieved secret.
+func (c *Collector) CountSecretRetrieved() {
+	c.secretsRetrieved.Inc()
+}
+
+// CountSecretExpired records a secret whose TTL ran out while it still had
+// reads remaining. For a single-read secret that means it was never
+// retrieved; a secret allowed several reads is counted even if some of them
+// were used.
+func (c *Collector) CountSecretExpired() {
+	c.secretsExpired.Inc()
+}
+
+// CountSecretCreateError records a failure to store a secret for the given
+// reason, one of the Reason* constants.
+func (c *Collector) CountSecretCreateError(reason string) {
+	c.createErrors.WithLabelValues(reason).Inc()
+}
+
+// CountSecretReadError records a failure to retrieve a secret for the given
+// reason, one of the Reason* constants.
+func (c *Collector) CountSecretReadError(reason string) {
+	c.readErrors.WithLabelValues(reason).Inc()
+}
+
+// ObserveHandlerLatency records how long the named handler operation took.
+func (c *Collector) ObserveHandlerLatency(operation string, duration time.Duration) {
+	c.handlerLatency.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// ObserveStorageLatency records how long the named storage backend round
+// trip took.
+func (c *Collector) ObserveStorageLatency(operation string, duration time.Duration) {
+	c.storageLatency.WithLabelValues(operation).Observe(duration.Seconds())
+}
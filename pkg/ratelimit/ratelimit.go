@@ -0,0 +1,174 @@
+// Package ratelimit provides Gin middleware that throttles secret creation
+// and lookup requests, and slows down brute-force enumeration of mnemos, all
+// backed by Redis so limits are shared across every instance of KeeDrop.
+//
+// Limits are keyed by client IP only. KeeDrop has no API-token or other
+// auth concept anywhere in the codebase, so there is nothing to key a
+// per-token bucket on; adding one would mean inventing an auth layer this
+// package has no business owning. If KeeDrop grows API tokens, give them
+// their own bucket the same way "create" and "lookup" have theirs.
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var logger = slog.Default()
+
+// Config controls the thresholds enforced by a Limiter.
+type Config struct {
+	// CreatePerMinute caps POST /api/secret requests per client IP.
+	CreatePerMinute int
+	// LookupPerMinute caps GET /api/secret/:mnemo requests per client IP.
+	LookupPerMinute int
+	// MaxFailedLookups is how many lookups that miss (wrong or expired
+	// mnemo) a client IP may make before it is temporarily blocked, to
+	// slow down brute-force enumeration of 10-character mnemos.
+	MaxFailedLookups int
+	// BanDuration is how long a client IP stays blocked after reaching
+	// MaxFailedLookups.
+	BanDuration time.Duration
+}
+
+// NewConfigFromEnv reads KEEDROP_RL_* environment variables, falling back to
+// generous defaults so the middleware is safe to enable without tuning.
+func NewConfigFromEnv() Config {
+	return Config{
+		CreatePerMinute:  envInt("KEEDROP_RL_CREATE_PER_MIN", 30),
+		LookupPerMinute:  envInt("KEEDROP_RL_LOOKUP_PER_MIN", 60),
+		MaxFailedLookups: envInt("KEEDROP_RL_MAX_FAILED_LOOKUPS", 10),
+		BanDuration:      time.Duration(envInt("KEEDROP_RL_BAN_DURATION", 900)) * time.Second,
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+// windowScript increments a counter and sets its expiry on first use, so
+// that the increment and the expiry stay atomic under concurrent requests.
+var windowScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Limiter enforces per-IP request and brute-force limits backed by Redis. A
+// nil *Limiter is valid and disables rate limiting entirely: every method on
+// it is a no-op, so callers that couldn't reach Redis at startup (see
+// storage.NewFromEnv's memory/bolt backends, which have no Redis of their
+// own) can wire it in unconditionally instead of branching at every call
+// site.
+type Limiter struct {
+	client redis.UniversalClient
+	cfg    Config
+}
+
+// New creates a Limiter that stores its counters on client.
+func New(client redis.UniversalClient, cfg Config) *Limiter {
+	return &Limiter{client: client, cfg: cfg}
+}
+
+// Ping reports whether the Redis instance backing this Limiter is
+// reachable, so it can be folded into a readiness probe. A nil Limiter is
+// always "ready" since it has nothing to check.
+func (l *Limiter) Ping(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	return l.client.Ping(ctx).Err()
+}
+
+// allow increments bucket:identifier within window and reports whether it
+// is still within limit. It fails open on Redis errors, logging them,
+// rather than letting an unreachable rate limiter take down the whole API.
+func (l *Limiter) allow(ctx context.Context, bucket, identifier string, limit int, window time.Duration) bool {
+	count, err := windowScript.Run(ctx, l.client, []string{"ratelimit:" + bucket + ":" + identifier}, window.Milliseconds()).Int()
+	if err != nil {
+		logger.Error("could not evaluate rate limit, failing open", "error", err)
+		return true
+	}
+	return count <= limit
+}
+
+// LimitCreates throttles POST /api/secret per client IP. It is a no-op on a
+// nil Limiter.
+func (l *Limiter) LimitCreates() gin.HandlerFunc {
+	if l == nil {
+		return func(ctx *gin.Context) { ctx.Next() }
+	}
+	return func(ctx *gin.Context) {
+		if !l.allow(ctx.Request.Context(), "create", ctx.ClientIP(), l.cfg.CreatePerMinute, time.Minute) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// LimitLookups throttles GET /api/secret/:mnemo per client IP, and blocks a
+// client outright once RecordFailedLookup has seen too many misses from it.
+// It is a no-op on a nil Limiter.
+func (l *Limiter) LimitLookups() gin.HandlerFunc {
+	if l == nil {
+		return func(ctx *gin.Context) { ctx.Next() }
+	}
+	return func(ctx *gin.Context) {
+		ip := ctx.ClientIP()
+		if l.isBlockedForFailures(ctx.Request.Context(), ip) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many failed lookups"})
+			return
+		}
+		if !l.allow(ctx.Request.Context(), "lookup", ip, l.cfg.LookupPerMinute, time.Minute) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RecordFailedLookup should be called whenever a lookup for ip misses
+// (unknown, expired or already-consumed mnemo), so repeated enumeration
+// attempts eventually trip the block enforced by LimitLookups. It is a
+// no-op on a nil Limiter.
+func (l *Limiter) RecordFailedLookup(ctx context.Context, ip string) {
+	if l == nil {
+		return
+	}
+	key := "ratelimit:lookup-failures:" + ip
+	count, err := windowScript.Run(ctx, l.client, []string{key}, l.cfg.BanDuration.Milliseconds()).Int()
+	if err != nil {
+		logger.Error("could not record failed lookup", "error", err)
+		return
+	}
+	if count >= l.cfg.MaxFailedLookups {
+		// the block has just been tripped: hold it for the full BanDuration
+		if err := l.client.PExpire(ctx, key, l.cfg.BanDuration).Err(); err != nil {
+			logger.Error("could not extend failed-lookup block", "error", err)
+		}
+	}
+}
+
+func (l *Limiter) isBlockedForFailures(ctx context.Context, ip string) bool {
+	count, err := l.client.Get(ctx, "ratelimit:lookup-failures:"+ip).Int()
+	if err != nil && err != redis.Nil {
+		logger.Error("could not check failed-lookup block, failing open", "error", err)
+		return false
+	}
+	return count >= l.cfg.MaxFailedLookups
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"time"
+
+	"github.com/milgner/keedrop/pkg/metrics"
+	"go.etcd.io/bbolt"
+)
+
+var secretsBucket = []byte("secrets")
+
+// boltEntry is the on-disk representation of a stored secret, carrying its
+// own expiry and remaining-reads counter since bbolt has no native TTL
+// support and every read-modify-write has to go through a single
+// transaction.
+type boltEntry struct {
+	Data           SecretData `json:"data"`
+	PassphraseHash string     `json:"passphrase_hash,omitempty"`
+	Remaining      int        `json:"remaining"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+}
+
+// boltStorage persists secrets in a local BoltDB file, for small
+// self-hosted deployments that want persistence without running Redis.
+type boltStorage struct {
+	db        *bbolt.DB
+	collector *metrics.Collector
+	cancel    context.CancelFunc
+}
+
+// NewBoltStorage opens (creating if necessary) the BoltDB file at path and
+// starts its background TTL reaper.
+func NewBoltStorage(path string, collector *metrics.Collector) (Storage, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(secretsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &boltStorage{db: db, collector: collector, cancel: cancel}
+	go s.reap(ctx)
+	return s, nil
+}
+
+func (s *boltStorage) Put(_ context.Context, mnemo string, data *SecretData, opts PutOptions) error {
+	maxReads := opts.MaxReads
+	if maxReads < 1 {
+		maxReads = 1
+	}
+	encoded, err := json.Marshal(boltEntry{
+		Data:           *data,
+		PassphraseHash: opts.PassphraseHash,
+		Remaining:      maxReads,
+		ExpiresAt:      time.Now().Add(opts.TTL),
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(secretsBucket)
+		if bucket.Get([]byte(mnemo)) != nil {
+			return ErrMnemoExists
+		}
+		return bucket.Put([]byte(mnemo), encoded)
+	})
+}
+
+func (s *boltStorage) PopOnce(_ context.Context, mnemo string, passphraseProof string) (*SecretData, bool, error) {
+	var entry *boltEntry
+	var expired, mismatch bool
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(secretsBucket)
+		key := []byte(mnemo)
+		raw := bucket.Get(key)
+		if raw == nil {
+			return nil
+		}
+		decoded := new(boltEntry)
+		if err := json.Unmarshal(raw, decoded); err != nil {
+			return err
+		}
+		if time.Now().After(decoded.ExpiresAt) { // reaper hasn't gotten to it yet
+			expired = true
+			return nil
+		}
+		if decoded.PassphraseHash != "" && subtle.ConstantTimeCompare([]byte(decoded.PassphraseHash), []byte(passphraseProof)) != 1 {
+			mismatch = true
+			return nil
+		}
+		entry = decoded
+		decoded.Remaining--
+		if decoded.Remaining <= 0 {
+			return bucket.Delete(key)
+		}
+		reencoded, err := json.Marshal(decoded)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, reencoded)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if mismatch {
+		return nil, false, ErrPassphraseMismatch
+	}
+	if expired || entry == nil {
+		return nil, false, nil
+	}
+	return &entry.Data, true, nil
+}
+
+func (s *boltStorage) Close() error {
+	s.cancel()
+	return s.db.Close()
+}
+
+// Ping always succeeds once NewBoltStorage has opened the database file: an
+// already-open bbolt.DB has no further connectivity to lose.
+func (s *boltStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// reap periodically removes entries whose TTL has elapsed without ever
+// being fully consumed, counting each one as an expired secret.
+func (s *boltStorage) reap(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapExpired()
+		}
+	}
+}
+
+func (s *boltStorage) reapExpired() {
+	now := time.Now()
+	var expiredKeys [][]byte
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(secretsBucket).ForEach(func(key, raw []byte) error {
+			entry := new(boltEntry)
+			if err := json.Unmarshal(raw, entry); err != nil {
+				return nil
+			}
+			if now.After(entry.ExpiresAt) {
+				expiredKeys = append(expiredKeys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+	})
+	if len(expiredKeys) == 0 {
+		return
+	}
+
+	_ = s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(secretsBucket)
+		for _, key := range expiredKeys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for range expiredKeys {
+		s.collector.CountSecretExpired()
+	}
+}
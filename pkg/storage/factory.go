@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/milgner/keedrop/pkg/metrics"
+)
+
+// NewFromEnv builds the Storage backend selected by KEEDROP_STORAGE
+// (redis|memory|bolt), defaulting to redis to match KeeDrop's original
+// deployment model.
+func NewFromEnv(collector *metrics.Collector) (Storage, error) {
+	switch backend := getEnvOrDefault("KEEDROP_STORAGE", BackendRedis); backend {
+	case BackendRedis:
+		return NewRedisStorage(NewRedisConfigFromEnv(), collector)
+	case BackendMemory:
+		return NewMemoryStorage(collector), nil
+	case BackendBolt:
+		return NewBoltStorage(getEnvOrDefault("KEEDROP_BOLT_PATH", "keedrop.db"), collector)
+	default:
+		return nil, fmt.Errorf("storage: unknown KEEDROP_STORAGE backend %q", backend)
+	}
+}
+
+func getEnvOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
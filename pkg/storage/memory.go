@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/milgner/keedrop/pkg/metrics"
+)
+
+// reapInterval controls how often memoryStorage and boltStorage sweep for
+// secrets that expired without ever being retrieved.
+const reapInterval = 30 * time.Second
+
+type memoryEntry struct {
+	data           *SecretData
+	passphraseHash string
+	remaining      int
+	expiresAt      time.Time
+}
+
+// memoryStorage keeps secrets in an in-process map. It has no external
+// dependencies, which makes it useful for tests and single-container demos
+// that don't want to run Redis.
+type memoryStorage struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	collector *metrics.Collector
+	cancel    context.CancelFunc
+}
+
+// NewMemoryStorage creates a memoryStorage and starts its background TTL
+// reaper.
+func NewMemoryStorage(collector *metrics.Collector) Storage {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &memoryStorage{entries: make(map[string]*memoryEntry), collector: collector, cancel: cancel}
+	go s.reap(ctx)
+	return s
+}
+
+func (s *memoryStorage) Put(_ context.Context, mnemo string, data *SecretData, opts PutOptions) error {
+	maxReads := opts.MaxReads
+	if maxReads < 1 {
+		maxReads = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[mnemo]; exists {
+		return ErrMnemoExists
+	}
+	s.entries[mnemo] = &memoryEntry{
+		data:           data,
+		passphraseHash: opts.PassphraseHash,
+		remaining:      maxReads,
+		expiresAt:      time.Now().Add(opts.TTL),
+	}
+	return nil
+}
+
+func (s *memoryStorage) PopOnce(_ context.Context, mnemo string, passphraseProof string) (*SecretData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[mnemo]
+	if !ok || time.Now().After(entry.expiresAt) { // reaper hasn't gotten to it yet
+		return nil, false, nil
+	}
+	if entry.passphraseHash != "" && subtle.ConstantTimeCompare([]byte(entry.passphraseHash), []byte(passphraseProof)) != 1 {
+		return nil, false, ErrPassphraseMismatch
+	}
+
+	entry.remaining--
+	if entry.remaining <= 0 {
+		delete(s.entries, mnemo)
+	}
+	return entry.data, true, nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.cancel()
+	return nil
+}
+
+// Ping always succeeds: the in-process map has no external dependency that
+// could be unreachable.
+func (s *memoryStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// reap periodically removes entries whose TTL has elapsed without ever
+// being fully consumed, counting each one as an expired secret.
+func (s *memoryStorage) reap(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			now := time.Now()
+			for mnemo, entry := range s.entries {
+				if now.After(entry.expiresAt) {
+					delete(s.entries, mnemo)
+					s.collector.CountSecretExpired()
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
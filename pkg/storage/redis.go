@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/milgner/keedrop/pkg/metrics"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisMode selects how the Redis client connects to its backend.
+type redisMode string
+
+const (
+	redisModeSingle   redisMode = "single"
+	redisModeSentinel redisMode = "sentinel"
+	redisModeCluster  redisMode = "cluster"
+)
+
+// RedisConfig describes how to reach Redis, whether that's a single node, a
+// Sentinel-monitored failover group or a Cluster, and is assembled from
+// environment variables by NewRedisConfigFromEnv.
+type RedisConfig struct {
+	Mode       redisMode
+	Addrs      []string
+	MasterName string // only used in sentinel mode
+	Username   string
+	Password   string
+	DB         int
+	UseTLS     bool
+}
+
+// NewRedisConfigFromEnv builds a RedisConfig from KEEDROP_REDIS_* environment
+// variables, defaulting to a single node on localhost:6379 so existing
+// deployments keep working without extra configuration. Besides the redis
+// storage backend, it is also used to point pkg/ratelimit at the same
+// Redis deployment.
+func NewRedisConfigFromEnv() RedisConfig {
+	cfg := RedisConfig{
+		Mode:       redisMode(getEnvOrDefault("KEEDROP_REDIS_MODE", string(redisModeSingle))),
+		Addrs:      strings.Split(getEnvOrDefault("KEEDROP_REDIS_ADDRS", "localhost:6379"), ","),
+		MasterName: getEnvOrDefault("KEEDROP_REDIS_MASTER_NAME", ""),
+		Username:   os.Getenv("KEEDROP_REDIS_USERNAME"),
+		Password:   os.Getenv("KEEDROP_REDIS_PASSWORD"),
+	}
+	if db, err := strconv.Atoi(getEnvOrDefault("KEEDROP_REDIS_DB", "0")); err == nil {
+		cfg.DB = db
+	}
+	if useTLS, err := strconv.ParseBool(getEnvOrDefault("KEEDROP_REDIS_TLS", "false")); err == nil {
+		cfg.UseTLS = useTLS
+	}
+	return cfg
+}
+
+// NewClient builds the redis.UniversalClient matching the configured mode so
+// the rest of the application can treat single-node, Sentinel and Cluster
+// deployments identically.
+func (cfg RedisConfig) NewClient() redis.UniversalClient {
+	var tlsConfig *tls.Config
+	if cfg.UseTLS {
+		tlsConfig = &tls.Config{}
+	}
+
+	switch cfg.Mode {
+	case redisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.Addrs,
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			DB:            cfg.DB,
+			TLSConfig:     tlsConfig,
+		})
+	case redisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     cfg.Addrs,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			TLSConfig: tlsConfig,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      cfg.Addrs[0],
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			DB:        cfg.DB,
+			TLSConfig: tlsConfig,
+		})
+	}
+}
+
+// putScript stores a secret in a Redis hash, failing if the mnemo is
+// already in use, so collision detection and the write happen atomically.
+var putScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'data', ARGV[1], 'passphrase_hash', ARGV[2], 'remaining', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// popScript atomically decrements the remaining-reads counter and deletes
+// the hash once it reaches zero, returning the stored ciphertext. It does
+// not itself check the passphrase proof: Lua's == on strings is not
+// constant-time, so PopOnce compares it in Go with crypto/subtle before
+// ever running this script.
+var popScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {'not_found', ''}
+end
+local data = redis.call('HGET', KEYS[1], 'data')
+local remaining = redis.call('HINCRBY', KEYS[1], 'remaining', -1)
+if remaining <= 0 then
+	redis.call('DEL', KEYS[1])
+end
+return {'ok', data}
+`)
+
+// redisStorage stores secrets as Redis hashes so that the remaining-reads
+// counter, passphrase hash and ciphertext can be updated atomically through
+// putScript and popScript.
+type redisStorage struct {
+	client    redis.UniversalClient
+	collector *metrics.Collector
+	cancel    context.CancelFunc
+}
+
+// NewRedisStorage connects to Redis per cfg and starts a background watcher
+// that counts secrets which expire before they are ever retrieved.
+func NewRedisStorage(cfg RedisConfig, collector *metrics.Collector) (Storage, error) {
+	client := cfg.NewClient()
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		return nil, err
+	}
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go collector.WatchExpirations(ctx, client, cfg.DB)
+
+	return &redisStorage{client: client, collector: collector, cancel: cancel}, nil
+}
+
+func (s *redisStorage) Put(ctx context.Context, mnemo string, data *SecretData, opts PutOptions) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	maxReads := opts.MaxReads
+	if maxReads < 1 {
+		maxReads = 1
+	}
+	created, err := putScript.Run(ctx, s.client, []string{mnemo},
+		jsonData, opts.PassphraseHash, maxReads, opts.TTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return ErrMnemoExists
+	}
+	return nil
+}
+
+func (s *redisStorage) PopOnce(ctx context.Context, mnemo string, passphraseProof string) (*SecretData, bool, error) {
+	storedHash, err := s.client.HGet(ctx, mnemo, "passphrase_hash").Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if storedHash != "" && subtle.ConstantTimeCompare([]byte(storedHash), []byte(passphraseProof)) != 1 {
+		return nil, false, ErrPassphraseMismatch
+	}
+
+	result, err := popScript.Run(ctx, s.client, []string{mnemo}).StringSlice()
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch status, encoded := result[0], result[1]; status {
+	case "not_found":
+		return nil, false, nil
+	default:
+		secret := new(SecretData)
+		if err := json.Unmarshal([]byte(encoded), secret); err != nil {
+			return nil, false, err
+		}
+		return secret, true, nil
+	}
+}
+
+func (s *redisStorage) Close() error {
+	s.cancel()
+	return s.client.Close()
+}
+
+// Ping checks that Redis is reachable.
+func (s *redisStorage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
@@ -0,0 +1,69 @@
+// Package storage provides a pluggable persistence layer for secrets,
+// decoupling the HTTP handlers from any particular backend.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// SecretData is the payload clients submit and retrieve. Only the
+// ciphertext and the bits required to decrypt it client-side are ever
+// persisted; the encryption key itself never reaches the server.
+type SecretData struct {
+	PubKey string `json:"pubkey" binding:"required"`
+	Nonce  string `json:"nonce" binding:"required"`
+	// Secret is deliberately not binding:"required": storeSecret checks it
+	// explicitly so it can report metrics.ReasonSecretMissing instead of
+	// collapsing it into the generic invalid-JSON reason.
+	Secret string `json:"secret"`
+}
+
+// ErrMnemoExists is returned by Put when the given mnemo is already taken,
+// so callers can retry with a freshly generated one.
+var ErrMnemoExists = errors.New("storage: mnemo already exists")
+
+// ErrPassphraseMismatch is returned by PopOnce when the secret is
+// passphrase-gated and the supplied proof doesn't match the hash it was
+// stored with. The read is not counted against MaxReads.
+var ErrPassphraseMismatch = errors.New("storage: passphrase proof does not match")
+
+// PutOptions controls the burn-after-reads, expiry and passphrase gating
+// behaviour of a stored secret.
+type PutOptions struct {
+	// TTL is how long the secret may be retrieved before it expires.
+	TTL time.Duration
+	// MaxReads is how many times PopOnce may successfully return the
+	// secret before it is deleted. Must be at least 1.
+	MaxReads int
+	// PassphraseHash, if non-empty, must be matched by the proof passed to
+	// PopOnce before the secret is returned.
+	PassphraseHash string
+}
+
+// Storage is implemented by every secret storage backend KeeDrop supports.
+type Storage interface {
+	// Put stores data under mnemo according to opts. It returns
+	// ErrMnemoExists if mnemo is already in use.
+	Put(ctx context.Context, mnemo string, data *SecretData, opts PutOptions) error
+	// PopOnce atomically retrieves the secret stored under mnemo,
+	// decrementing its remaining-reads counter and deleting it once that
+	// counter reaches zero. The second return value is false if mnemo was
+	// never used or has already been fully consumed. passphraseProof is
+	// compared against the stored passphrase hash, if any; a mismatch
+	// returns ErrPassphraseMismatch without consuming a read.
+	PopOnce(ctx context.Context, mnemo string, passphraseProof string) (*SecretData, bool, error)
+	// Close releases any resources held by the backend.
+	Close() error
+	// Ping reports whether the backend is reachable and able to serve
+	// requests, so it can back a readiness probe.
+	Ping(ctx context.Context) error
+}
+
+// Backend names accepted by the KEEDROP_STORAGE environment variable.
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
@@ -0,0 +1,39 @@
+// Package tracing wires up OpenTelemetry tracing for KeeDrop.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// ServiceName identifies KeeDrop in exported spans.
+const ServiceName = "keedrop"
+
+// Init configures the global TracerProvider to batch-export spans via
+// OTLP/gRPC, honoring the standard OTEL_EXPORTER_OTLP_ENDPOINT (and related)
+// environment variables so operators can point it at Jaeger, Tempo or any
+// other OTLP-compatible backend without code changes. The returned shutdown
+// function should be deferred so buffered spans are flushed on exit.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName(ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
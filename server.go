@@ -2,162 +2,335 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
 	"github.com/dchest/uniuri"
-	"github.com/fvbock/endless"
 	"github.com/gin-gonic/gin"
-	"github.com/mediocregopher/radix.v2/pool"
-	"github.com/mediocregopher/radix.v2/redis"
-	"github.com/op/go-logging"
-	"net/http"
+	"github.com/milgner/keedrop/pkg/metrics"
+	"github.com/milgner/keedrop/pkg/ratelimit"
+	"github.com/milgner/keedrop/pkg/storage"
+	"github.com/milgner/keedrop/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	listenPort              = ":8080"
-	mnemoLen                = 10
-	defaultLifetime         = 60 * 60 * 24
-	maxMnemoFindTries       = 10
-	secretsStoredCounter    = "KeeDropStoredKeysCounter"
-	secretsRetrievedCounter = "KeeDropRetrievedKeysCounter"
+	listenPort            = ":8080"
+	mnemoLen              = 10
+	defaultLifetime       = 60 * 60 * 24 * time.Second
+	defaultMaxReads       = 1
+	defaultMaxSecretBytes = 64 * 1024
+	maxMnemoFindTries     = 10
+	passphraseProofHeader = "X-Keedrop-Passphrase-Proof"
+	requestIDHeader       = "X-Request-Id"
+	readyTimeout          = 2 * time.Second
+	shutdownTimeout       = 15 * time.Second
 )
 
-var logger = logging.MustGetLogger("keedrop")
+// logger emits structured JSON lines. It never receives the mnemo or
+// ciphertext itself, only their lengths, so request logs stay safe to ship
+// to a shared log sink.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-// structure to store the secret in Redis
-// only the secret key remains with the sender
-// secret for test.json: Lz5DP4grKMN9efoL9dt!S81X7AFGhin3OHDgbB8qcqQ=
-type secretData struct {
-	PubKey string `json:"pubkey" binding:"required"`
-	Nonce  string `json:"nonce" binding:"required"`
-	Secret string `json:"secret" binding:"required"`
-}
+var collector = metrics.NewCollector(prometheus.DefaultRegisterer)
 
-func increaseCounter(redis *redis.Client, counterName string) {
-	if _, err := redis.Cmd("INCR", counterName).Int64(); err != nil {
-		logger.Error("Could not increase counter", err)
+var tracer = otel.Tracer("keedrop")
+
+// limiter is set up in main once the Redis connection it rides on is
+// available.
+var limiter *ratelimit.Limiter
+
+// maxLifetime caps how long a caller may ask a secret to live for via
+// ttl_seconds, configurable via KEEDROP_MAX_TTL_SECONDS so operators can
+// tighten or loosen it without a rebuild.
+var maxLifetime = readMaxLifetimeFromEnv()
+
+func readMaxLifetimeFromEnv() time.Duration {
+	if value := os.Getenv("KEEDROP_MAX_TTL_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
 	}
+	return defaultLifetime
 }
 
-// stores the secret in Redis and returns the key(mnemo) where it can be found
-func saveInRedis(redis *pool.Pool, data *secretData) (string, bool) {
-	conn, err := redis.Get()
-	if err != nil {
-		logger.Error("Could not connect to Redis")
-		return "", false
+// maxSecretBytes caps the size of the encrypted payload a caller may submit,
+// configurable via KEEDROP_MAX_SECRET_BYTES.
+var maxSecretBytes = readMaxSecretBytesFromEnv()
+
+func readMaxSecretBytesFromEnv() int {
+	if value := os.Getenv("KEEDROP_MAX_SECRET_BYTES"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
 	}
-	defer redis.Put(conn)
+	return defaultMaxSecretBytes
+}
+
+// the Gin handlers all want access to the storage backend, too
+type storageUsingGinHandler func(storage.Storage, *gin.Context)
+
+// secretCreateRequest is the POST /api/secret request body: the encrypted
+// payload plus the optional burn-after-reads, expiry and passphrase
+// gating settings.
+type secretCreateRequest struct {
+	storage.SecretData
+	TTLSeconds     int    `json:"ttl_seconds"`
+	MaxReads       int    `json:"max_reads"`
+	PassphraseHash string `json:"passphrase_hash"`
+}
+
+// putSecret picks a free mnemo and stores data under it, retrying on
+// collisions up to maxMnemoFindTries times.
+func putSecret(ctx context.Context, store storage.Storage, req *secretCreateRequest) (string, bool) {
+	ctx, span := tracer.Start(ctx, "keedrop.store_secret")
+	defer span.End()
+	span.SetAttributes(attribute.String("keedrop.operation", "store"))
 
-	jsonData, jsonErr := json.Marshal(data)
-	if jsonErr != nil {
-		logger.Error("Could not marshal secret to JSON.", jsonErr)
-		return "", false
+	ttl := defaultLifetime
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
 	}
+	if ttl > maxLifetime {
+		ttl = maxLifetime
+	}
+	maxReads := req.MaxReads
+	if maxReads < 1 {
+		maxReads = defaultMaxReads
+	}
+	opts := storage.PutOptions{TTL: ttl, MaxReads: maxReads, PassphraseHash: req.PassphraseHash}
+
 	for i := 0; i < maxMnemoFindTries; i++ {
 		mnemo := uniuri.NewLen(mnemoLen)
-		if _, err := conn.Cmd("SET", mnemo, jsonData, "NX", "EX", defaultLifetime).Str(); err == nil {
-			increaseCounter(conn, secretsStoredCounter)
+		start := time.Now()
+		err := store.Put(ctx, mnemo, &req.SecretData, opts)
+		collector.ObserveStorageLatency("store", time.Since(start))
+		if err == nil {
+			collector.CountSecretCreated()
 			return mnemo, true
-		} else {
-			logger.Error("Could not write secret, probably key collision.", err)
 		}
+		if err != storage.ErrMnemoExists {
+			logger.Error("could not store secret", "error", err)
+			collector.CountSecretCreateError(metrics.ReasonStorageError)
+			return "", false
+		}
+		logger.Warn("mnemo collision, retrying", "error", err)
 	}
-	logger.Error("Could not find unused mnemo after", maxMnemoFindTries, "tries")
+	logger.Error("could not find unused mnemo", "tries", maxMnemoFindTries)
+	collector.CountSecretCreateError(metrics.ReasonMnemoCollisionExhausted)
 	return "", false
 }
 
-// retrieves the secret from Redis, deleting it at the same time
-func loadFromRedis(redis *pool.Pool, mnemo string) (*secretData, bool) {
-	conn, err := redis.Get()
-	if err != nil {
-		logger.Error("Could not connect to Redis.", err)
-		return nil, false
-	}
-	defer redis.Put(conn)
+// getSecret retrieves the secret stored under mnemo, checking passphraseProof
+// against it first if it is passphrase-gated.
+func getSecret(ctx context.Context, store storage.Storage, mnemo string, passphraseProof string) (*storage.SecretData, bool, error) {
+	ctx, span := tracer.Start(ctx, "keedrop.retrieve_secret")
+	defer span.End()
+	span.SetAttributes(attribute.String("keedrop.operation", "retrieve"))
 
-	conn.PipeAppend("MULTI")
-	conn.PipeAppend("GET", mnemo)
-	conn.PipeAppend("DEL", mnemo)
-	conn.PipeAppend("EXEC")
-
-	// the first 3 commands should only contain "OK" and "QUEUED", no real data
-	for i := 0; i < 3; i++ {
-		if err := conn.PipeResp().Err; err != nil {
-			logger.Error("Redis error.", err)
-			return nil, false
-		}
+	start := time.Now()
+	secret, found, err := store.PopOnce(ctx, mnemo, passphraseProof)
+	collector.ObserveStorageLatency("retrieve", time.Since(start))
+	span.SetAttributes(attribute.Bool("keedrop.mnemo_found", found))
+	if err == storage.ErrPassphraseMismatch {
+		return nil, false, err
 	}
-	if results, err := conn.PipeResp().Array(); err == nil {
-		// array contains the results after MULTI in order
-		encodedData, _ := results[0].Bytes()
-		if len(encodedData) == 0 { // it means the secret wasn't found
-			return nil, true
-		} else {
-			secret := new(secretData)
-			if err := json.Unmarshal(encodedData, secret); err == nil {
-				increaseCounter(conn, secretsRetrievedCounter)
-				return secret, true
-			} else {
-				logger.Error("Could not unmarshal JSON data: ", encodedData)
-				return nil, false
-			}
-		}
-	} else {
-		logger.Error("Error executing batch.", err)
-		return nil, false
+	if err != nil {
+		logger.Error("storage error", "error", err)
+		collector.CountSecretReadError(metrics.ReasonStorageError)
+		return nil, false, err
+	}
+	if !found {
+		collector.CountSecretReadError(metrics.ReasonSecretNotFound)
+		return nil, true, nil
 	}
+	collector.CountSecretRetrieved()
+	return secret, true, nil
 }
 
-// the Gin handlers all want a Redis connection, too
-type redisUsingGinHandler func(*pool.Pool, *gin.Context)
-
 // POST /api/secret
-func storeSecret(redis *pool.Pool, ctx *gin.Context) {
-	var secret secretData
-	if ctx.BindJSON(&secret) == nil {
-		if mnemo, ok := saveInRedis(redis, &secret); ok {
-			ctx.JSON(http.StatusOK, gin.H{"mnemo": mnemo})
-		} else {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store secret"})
-		}
-	} else {
+func storeSecret(store storage.Storage, ctx *gin.Context) {
+	defer observeHandlerLatency("store", time.Now())
+	var req secretCreateRequest
+	if ctx.BindJSON(&req) != nil {
+		collector.CountSecretCreateError(metrics.ReasonInvalidJSON)
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad JSON data"})
+		return
+	}
+	if req.Secret == "" {
+		collector.CountSecretCreateError(metrics.ReasonSecretMissing)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "secret is required"})
+		return
+	}
+	if len(req.Secret) > maxSecretBytes {
+		collector.CountSecretCreateError(metrics.ReasonSecretTooLarge)
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "secret too large"})
+		return
+	}
+	if mnemo, ok := putSecret(ctx.Request.Context(), store, &req); ok {
+		ctx.JSON(http.StatusOK, gin.H{"mnemo": mnemo})
+	} else {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store secret"})
 	}
 }
 
 // GET /api/secret/:mnemo
-func retrieveSecret(redis *pool.Pool, ctx *gin.Context) {
+func retrieveSecret(store storage.Storage, ctx *gin.Context) {
+	defer observeHandlerLatency("retrieve", time.Now())
 	mnemo := ctx.Param("mnemo")
-	logger.Debug("Reading data for mnemo:", mnemo)
-	if secret, ok := loadFromRedis(redis, mnemo); !ok {
+	proof := ctx.GetHeader(passphraseProofHeader)
+	switch secret, ok, err := getSecret(ctx.Request.Context(), store, mnemo, proof); {
+	case err == storage.ErrPassphraseMismatch:
+		limiter.RecordFailedLookup(ctx.Request.Context(), ctx.ClientIP())
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "wrong passphrase"})
+	case !ok:
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read secret"})
-	} else {
-		if secret == nil {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "No such secret"})
-		} else {
-			ctx.JSON(http.StatusOK, secret)
-		}
+	case secret == nil:
+		limiter.RecordFailedLookup(ctx.Request.Context(), ctx.ClientIP())
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No such secret"})
+	default:
+		ctx.JSON(http.StatusOK, secret)
+	}
+}
+
+// GET /healthz - liveness probe: if the process can answer, it's alive.
+func healthz(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GET /readyz - readiness probe: only reports ready once the storage
+// backend can be reached within readyTimeout.
+func readyz(store storage.Storage, ctx *gin.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx.Request.Context(), readyTimeout)
+	defer cancel()
+	if err := store.Ping(pingCtx); err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
+	}
+	// limiter is nil when rate limiting couldn't be wired up at startup;
+	// Ping is then a no-op, matching that it was already reported missing
+	// via the startup log line rather than failing requests silently.
+	if err := limiter.Ping(pingCtx); err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+func observeHandlerLatency(operation string, start time.Time) {
+	collector.ObserveHandlerLatency(operation, time.Since(start))
+}
+
+// ensures that the Gin handler function receives the storage backend, too
+func wrapHandler(store storage.Storage, wrapped storageUsingGinHandler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		wrapped(store, ctx)
 	}
 }
 
-// ensures that the Gin handler function receives a Redis connection, too
-func wrapHandler(redis *pool.Pool, wrapped redisUsingGinHandler) gin.HandlerFunc {
+// requestLogger logs one JSON line per request: request ID, remote IP,
+// method, path, status, latency and the mnemo's length (never its value, or
+// the secret payload).
+func requestLogger() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		wrapped(redis, ctx)
+		start := time.Now()
+		requestID := uniuri.New()
+		ctx.Header(requestIDHeader, requestID)
+
+		ctx.Next()
+
+		logger.Info("handled request",
+			"request_id", requestID,
+			"remote_ip", ctx.ClientIP(),
+			"method", ctx.Request.Method,
+			"path", ctx.FullPath(),
+			"status", ctx.Writer.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"mnemo_length", len(ctx.Param("mnemo")),
+		)
 	}
 }
 
 // application entry point
 func main() {
-	redis, err := pool.New("tcp", "localhost:6379", 10)
+	ctx := context.Background()
+	shutdownTracing, err := tracing.Init(ctx)
+	if err != nil {
+		logger.Error("could not initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(ctx)
+
+	store, err := storage.NewFromEnv(collector)
 	if err != nil {
-		logger.Fatal("Cannot connect to Redis")
+		logger.Error("cannot initialize storage backend", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	// Rate limiting opens its own Redis connection (built from the same
+	// KEEDROP_REDIS_* config as the redis storage backend, there is no
+	// separate KEEDROP_RL_REDIS_* yet) so it works regardless of
+	// KEEDROP_STORAGE: memory/bolt deployments have no Redis of their own.
+	// If that Redis isn't reachable at startup, disable rate limiting
+	// outright rather than having every request silently fail open
+	// against a dead client.
+	rlClient := storage.NewRedisConfigFromEnv().NewClient()
+	defer rlClient.Close()
+	if err := rlClient.Ping(ctx).Err(); err != nil {
+		logger.Warn("rate limiting disabled: redis unreachable", "error", err)
+	} else {
+		limiter = ratelimit.New(rlClient, ratelimit.NewConfigFromEnv())
+	}
+
+	router := gin.New()
+	// KeeDrop isn't deployed behind a known, fixed set of proxies, so
+	// trust no hop-by-hop client IP headers: otherwise ctx.ClientIP(), the
+	// key the rate limiter and brute-force protection bucket on, would
+	// trust an X-Forwarded-For/X-Real-IP set by whoever is making the
+	// request, letting them pick a fresh bucket on every call.
+	router.ForwardedByClientIP = false
+	if err := router.SetTrustedProxies(nil); err != nil {
+		logger.Error("could not configure trusted proxies", "error", err)
+		os.Exit(1)
 	}
-	router := gin.Default()
+	router.Use(gin.Recovery(), otelgin.Middleware(tracing.ServiceName), requestLogger())
 
-	router.POST("/api/secret", wrapHandler(redis, storeSecret))
-	router.GET("/api/secret/:mnemo", wrapHandler(redis, retrieveSecret))
+	router.POST("/api/secret", limiter.LimitCreates(), wrapHandler(store, storeSecret))
+	router.GET("/api/secret/:mnemo", limiter.LimitLookups(), wrapHandler(store, retrieveSecret))
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", wrapHandler(store, readyz))
 	router.Static("/assets", "./assets")
 	router.StaticFile("/r", "./retrieve.html")
 	router.StaticFile("/", "./store.html")
-	endless.ListenAndServe(listenPort, router)
+
+	srv := &http.Server{Addr: listenPort, Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server stopped unexpectedly", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	stop, cancelStop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancelStop()
+	<-stop.Done()
+
+	logger.Info("shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("graceful shutdown failed", "error", err)
+	}
 }